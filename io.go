@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// -names (and stdin) used to be the only way in, and stdout text the
+// only way out. InputSource/OutputSink pull those concerns out from
+// behind the chin/chout pipeline so headless, long-lived scanning jobs
+// can read from and write to something other than files, without the
+// resolver core in spark.go/lookup noticing the difference.
+var namesCSV = flag.String("names-csv", "", "Select a column out of a CSV -names file, format col=<name>")
+var namesKafka = flag.String("names-kafka", "", "Consume domain names from Kafka, format brokers,topic (last element is the topic)")
+
+var outNDJSONFile = flag.String("out-ndjson-file", "", "Write ndjson results to this file, rotated by size")
+var outRotateBytes = flag.Int64("out-rotate-bytes", 100*1024*1024, "Rotate -out-ndjson-file after this many bytes")
+var outZoneFile = flag.String("out-zone-file", "", "Append the rdata of each resolved RR, one per line, to this file")
+var outKafka = flag.String("out-kafka", "", "Publish results to Kafka, format brokers,topic (last element is the topic)")
+var outNats = flag.String("out-nats", "", "Publish results to NATS, format url,subject")
+
+// InputSource produces domain names onto out and returns when it is
+// exhausted (or, for the Kafka consumer, runs until reading from the
+// broker fails or the process is killed - it's meant to back a
+// long-lived service).
+type InputSource interface {
+	Stream(out chan<- string) error
+}
+
+// OutputSink consumes one Result per resolved name.
+type OutputSink interface {
+	Write(res Result) error
+	Close() error
+}
+
+// newInputSource picks the input implementation from -names-kafka,
+// -names-csv and -names/stdin, in that precedence order.
+func newInputSource() (InputSource, error) {
+	if *namesKafka != "" {
+		brokers, topic, err := splitBrokersTopic(*namesKafka)
+		if err != nil {
+			return nil, err
+		}
+		return &kafkaInputSource{brokers: brokers, topic: topic}, nil
+	}
+	if *namesCSV != "" {
+		col := strings.TrimPrefix(*namesCSV, "col=")
+		if col == *namesCSV {
+			return nil, fmt.Errorf("-names-csv must be of the form col=<name>, got %q", *namesCSV)
+		}
+		return &csvInputSource{path: *domainfile, col: col}, nil
+	}
+	return &lineInputSource{path: *domainfile}, nil
+}
+
+// newOutputSink picks the output implementation from -out-kafka,
+// -out-nats, -out-zone-file and -out-ndjson-file, in that precedence
+// order. A nil sink (no error) means "none configured" - the caller
+// should fall back to the existing -format stdout path.
+func newOutputSink() (OutputSink, error) {
+	switch {
+	case *outKafka != "":
+		brokers, topic, err := splitBrokersTopic(*outKafka)
+		if err != nil {
+			return nil, err
+		}
+		return newKafkaSink(brokers, topic), nil
+	case *outNats != "":
+		url, subject, err := splitURLSubject(*outNats)
+		if err != nil {
+			return nil, err
+		}
+		return newNatsSink(url, subject)
+	case *outZoneFile != "":
+		if !*print_rrs {
+			return nil, fmt.Errorf("-out-zone-file requires -print_rrs to capture the resolved RRs it writes")
+		}
+		return newZoneFileSink(*outZoneFile)
+	case *outNDJSONFile != "":
+		return newRotatingNDJSONSink(*outNDJSONFile, *outRotateBytes)
+	default:
+		return nil, nil
+	}
+}
+
+func splitBrokersTopic(s string) (brokers []string, topic string, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < 2 {
+		return nil, "", fmt.Errorf("expected brokers,topic (at least one broker and a topic), got %q", s)
+	}
+	return parts[:len(parts)-1], parts[len(parts)-1], nil
+}
+
+func splitURLSubject(s string) (url, subject string, err error) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("expected url,subject, got %q", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// decompressingReader wraps r with gzip or zstd decompression based on
+// path's extension, or returns r unchanged.
+func decompressingReader(path string, r io.Reader) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(path, ".zst"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return r, nil
+	}
+}
+
+func openNamesFile(path string) (io.ReadCloser, error) {
+	if path == "" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// lineInputSource is the plain-text -names file (or stdin) reader,
+// transparently decompressing .gz/.zst files.
+type lineInputSource struct {
+	path string
+}
+
+func (s *lineInputSource) Stream(out chan<- string) error {
+	f, err := openNamesFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+	defer f.Close()
+
+	r, err := decompressingReader(s.path, f)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		dom := strings.TrimSpace(scanner.Text())
+		if dom == "" {
+			continue
+		}
+		out <- dom
+	}
+	return scanner.Err()
+}
+
+// csvInputSource selects a single column, by header name, out of a CSV
+// -names file.
+type csvInputSource struct {
+	path string
+	col  string
+}
+
+func (s *csvInputSource) Stream(out chan<- string) error {
+	f, err := openNamesFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+	defer f.Close()
+
+	r, err := decompressingReader(s.path, f)
+	if err != nil {
+		return err
+	}
+
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	idx := -1
+	for i, h := range header {
+		if h == s.col {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		return fmt.Errorf("column %q not found in CSV header %v", s.col, header)
+	}
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		out <- strings.TrimSpace(rec[idx])
+	}
+}
+
+// kafkaInputSource consumes domain names, one per message, from a Kafka
+// topic. It runs until the broker connection fails, backing a headless,
+// long-lived scanning job rather than a one-shot batch run.
+type kafkaInputSource struct {
+	brokers []string
+	topic   string
+}
+
+func (s *kafkaInputSource) Stream(out chan<- string) error {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: s.brokers,
+		Topic:   s.topic,
+		GroupID: "spark",
+	})
+	defer r.Close()
+
+	for {
+		m, err := r.ReadMessage(context.Background())
+		if err != nil {
+			return err
+		}
+		dom := strings.TrimSpace(string(m.Value))
+		if dom != "" {
+			out <- dom
+		}
+	}
+}
+
+// rotatingNDJSONSink writes one JSON object per line, rotating to a new
+// numbered file once the current one crosses maxBytes.
+type rotatingNDJSONSink struct {
+	base     string
+	maxBytes int64
+
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	written int64
+	part    int
+}
+
+func newRotatingNDJSONSink(base string, maxBytes int64) (*rotatingNDJSONSink, error) {
+	s := &rotatingNDJSONSink{base: base, maxBytes: maxBytes}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *rotatingNDJSONSink) rotate() error {
+	if s.f != nil {
+		s.f.Close()
+	}
+	name := s.base
+	if s.part > 0 {
+		name = fmt.Sprintf("%s.%d", s.base, s.part)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.enc = json.NewEncoder(f)
+	s.written = 0
+	s.part++
+	return nil
+}
+
+func (s *rotatingNDJSONSink) Write(res Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.written >= s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if err := s.enc.Encode(res); err != nil {
+		return err
+	}
+	s.written += int64(len(line)) + 1
+	return nil
+}
+
+func (s *rotatingNDJSONSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// zoneFileSink appends each string in Result.RRs, one per line, to an
+// append-only file. Result.RRs holds only each RR's rdata, so the lines
+// carry no owner name, TTL, class or type and the file is not a loadable
+// zone file. Result.RRs is only populated when -print_rrs is set, so newOutputSink
+// refuses to build one otherwise - without that check, -out-zone-file
+// would silently produce an empty file.
+type zoneFileSink struct {
+	f *os.File
+}
+
+func newZoneFileSink(path string) (*zoneFileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &zoneFileSink{f: f}, nil
+}
+
+func (s *zoneFileSink) Write(res Result) error {
+	for _, rr := range res.RRs {
+		if _, err := fmt.Fprintln(s.f, rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *zoneFileSink) Close() error {
+	return s.f.Close()
+}
+
+// kafkaSink publishes one JSON-encoded Result per message.
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+func newKafkaSink(brokers []string, topic string) *kafkaSink {
+	return &kafkaSink{w: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.LeastBytes{},
+	}}
+}
+
+func (s *kafkaSink) Write(res Result) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.w.WriteMessages(context.Background(), kafka.Message{Value: data})
+}
+
+func (s *kafkaSink) Close() error {
+	return s.w.Close()
+}
+
+// natsSink publishes one JSON-encoded Result per message to a NATS
+// subject.
+type natsSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func newNatsSink(url, subject string) (*natsSink, error) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &natsSink{nc: nc, subject: subject}, nil
+}
+
+func (s *natsSink) Write(res Result) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.nc.Publish(s.subject, data)
+}
+
+func (s *natsSink) Close() error {
+	return s.nc.Drain()
+}
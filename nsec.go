@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// -randomize exists specifically to force negative answers "for deeper
+// inspection", but until now the tool threw away the NSEC/NSEC3 proof
+// that came back with them. -dnssec-proof turns that proof into a
+// verdict instead, auditing whether the signer actually covers the
+// queried name.
+var dnssecProof = flag.Bool("dnssec-proof", false, "For NXDOMAIN/NODATA answers, verify the NSEC/NSEC3 denial-of-existence proof")
+
+// RFC 9276 recommends authoritative servers cap NSEC3 iterations at
+// 100; above that we refuse to chase the hash chain rather than burning
+// CPU on a signer that's ignoring the recommendation.
+const maxNSEC3Iterations = 100
+
+// checkDenialProof inspects an NXDOMAIN/NODATA answer message and
+// reports one of: valid, missing-nsec, wrong-range,
+// bad-closest-encloser, missing-wildcard-proof, nsec3-iterations-exceeded.
+// nxdomain selects which proof RFC 5155/4035 actually require: a NODATA
+// answer only needs the name's own (non-)existence established, while
+// NXDOMAIN additionally needs a third leg proving no wildcard at the
+// closest encloser could have answered instead.
+func checkDenialProof(qname string, nxdomain bool, msg *dns.Msg) string {
+	if msg == nil {
+		return "missing-nsec"
+	}
+	qname = dns.Fqdn(qname)
+
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range msg.Ns {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, v)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, v)
+		}
+	}
+
+	switch {
+	case len(nsec3s) > 0:
+		return checkNSEC3Proof(qname, nxdomain, nsec3s)
+	case len(nsecs) > 0:
+		return checkNSECProof(qname, nxdomain, nsecs)
+	default:
+		return "missing-nsec"
+	}
+}
+
+// checkNSECProof looks for a single NSEC record whose owner/next-owner
+// range brackets qname in canonical ordering (RFC 4034 section 6),
+// including the zone-apex wraparound case for the last NSEC in a zone.
+// For NODATA an NSEC owned by qname itself is also accepted: the name
+// exists and its type bitmap backs the denial.
+// For NXDOMAIN it also requires the RFC 4035 section 5.4 wildcard leg:
+// an NSEC covering "*.<closest encloser>", proving no wildcard could
+// have expanded to answer the query either.
+func checkNSECProof(qname string, nxdomain bool, nsecs []*dns.NSEC) string {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if strings.EqualFold(n.Hdr.Name, qname) {
+				return "valid"
+			}
+		}
+	}
+	covered := false
+	for _, n := range nsecs {
+		if nsecCovers(n.Hdr.Name, n.NextDomain, qname) {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return "wrong-range"
+	}
+	if !nxdomain {
+		return "valid"
+	}
+
+	closestEncloser := closestEncloserNSEC(qname, nsecs)
+	if closestEncloser == "" {
+		return "bad-closest-encloser"
+	}
+	wildcard := "*." + closestEncloser
+	for _, n := range nsecs {
+		if nsecCovers(n.Hdr.Name, n.NextDomain, wildcard) {
+			return "valid"
+		}
+	}
+	return "missing-wildcard-proof"
+}
+
+// closestEncloserNSEC finds qname's closest encloser - its longest
+// ancestor that appears as an NSEC owner name in the proof, i.e. the
+// longest ancestor known to exist.
+func closestEncloserNSEC(qname string, nsecs []*dns.NSEC) string {
+	labels := dns.SplitDomainName(qname)
+	for i := 1; i <= len(labels); i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, n := range nsecs {
+			if strings.EqualFold(n.Hdr.Name, candidate) {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+func nsecCovers(owner, next, qname string) bool {
+	if canonicalLess(owner, qname) && canonicalLess(qname, next) {
+		return true
+	}
+	// the last NSEC in a zone points back at the apex; anything
+	// canonically after owner, or before next, is covered
+	if !canonicalLess(next, owner) {
+		return false
+	}
+	return canonicalLess(owner, qname) || canonicalLess(qname, next)
+}
+
+// checkNSEC3Proof walks qname's ancestors to find the closest encloser
+// (the longest suffix an NSEC3 owner hash matches), then checks that
+// the next-closer name - one label below the closest encloser - is
+// covered by an NSEC3 range, which is the standard closest-encloser
+// proof of non-existence from RFC 5155. For NXDOMAIN it also requires
+// RFC 5155 section 8.3's third leg: an NSEC3 covering the wildcard at
+// the closest encloser, proving no wildcard could have answered either.
+func checkNSEC3Proof(qname string, nxdomain bool, nsec3s []*dns.NSEC3) string {
+	for _, n := range nsec3s {
+		if n.Iterations > maxNSEC3Iterations {
+			return "nsec3-iterations-exceeded"
+		}
+	}
+
+	labels := dns.SplitDomainName(qname)
+	if labels == nil {
+		labels = []string{}
+	}
+
+	closestIdx := -1
+	for i := 0; i < len(labels); i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, n := range nsec3s {
+			if n.Match(candidate) {
+				closestIdx = i
+				break
+			}
+		}
+		if closestIdx != -1 {
+			break
+		}
+	}
+	if closestIdx == -1 {
+		return "bad-closest-encloser"
+	}
+	if closestIdx == 0 {
+		// qname's own hash matched an NSEC3 owner: the name exists, so
+		// this is a NODATA proof backed by the type bitmap rather than
+		// a next-closer covering - nothing further to check here. For
+		// an NXDOMAIN answer it contradicts the rcode instead.
+		if nxdomain {
+			return "bad-closest-encloser"
+		}
+		return "valid"
+	}
+
+	nextCloser := dns.Fqdn(strings.Join(labels[closestIdx-1:], "."))
+	coveredNextCloser := false
+	for _, n := range nsec3s {
+		if n.Cover(nextCloser) {
+			coveredNextCloser = true
+			break
+		}
+	}
+	if !coveredNextCloser {
+		return "wrong-range"
+	}
+	if !nxdomain {
+		return "valid"
+	}
+
+	closestEncloser := dns.Fqdn(strings.Join(labels[closestIdx:], "."))
+	wildcard := "*." + closestEncloser
+	for _, n := range nsec3s {
+		if n.Cover(wildcard) {
+			return "valid"
+		}
+	}
+	return "missing-wildcard-proof"
+}
+
+// canonicalLess implements RFC 4034 section 6.1's canonical DNS name
+// ordering: labels are compared right-to-left (TLD first), lowercased,
+// with a shorter-but-otherwise-identical name sorting first.
+func canonicalLess(a, b string) bool {
+	la := canonicalLabels(a)
+	lb := canonicalLabels(b)
+	for i := 0; ; i++ {
+		ia := len(la) - 1 - i
+		ib := len(lb) - 1 - i
+		if ia < 0 && ib < 0 {
+			return false
+		}
+		if ia < 0 {
+			return true
+		}
+		if ib < 0 {
+			return false
+		}
+		if la[ia] != lb[ib] {
+			return la[ia] < lb[ib]
+		}
+	}
+}
+
+func canonicalLabels(name string) []string {
+	labels := dns.SplitDomainName(name)
+	out := make([]string, len(labels))
+	for i, l := range labels {
+		out[i] = strings.ToLower(l)
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// nsRateLimiter hands out a token-bucket limiter per upstream resolver
+// address, keyed by upstreamKey. -randomize runs frequently trip RRL on
+// the authoritative side; halving QPS on consecutive SERVFAILs and
+// recovering geometrically keeps a bulk scan from hammering a server
+// that has already started shedding load.
+type nsRateLimiter struct {
+	initialQPS float64
+	maxQPS     float64
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	servfail map[string]int
+}
+
+func newNSRateLimiter(initialQPS, maxQPS float64) *nsRateLimiter {
+	return &nsRateLimiter{
+		initialQPS: initialQPS,
+		maxQPS:     maxQPS,
+		limiters:   make(map[string]*rate.Limiter),
+		servfail:   make(map[string]int),
+	}
+}
+
+func (l *nsRateLimiter) limiterFor(ns string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim, ok := l.limiters[ns]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(l.initialQPS), 1)
+		l.limiters[ns] = lim
+	}
+	return lim
+}
+
+// wait blocks until ns (or "" for the default bucket) has a free token.
+func (l *nsRateLimiter) wait(ns string) {
+	l.limiterFor(ns).Wait(context.Background())
+}
+
+// onServfail halves the QPS allowed for ns; repeated consecutive
+// SERVFAILs keep halving it down towards a floor of one query per ten
+// seconds rather than ever reaching zero.
+func (l *nsRateLimiter) onServfail(ns string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.servfail[ns]++
+	lim := l.limiters[ns]
+	if lim == nil {
+		return
+	}
+	next := float64(lim.Limit()) / 2
+	if next < 0.1 {
+		next = 0.1
+	}
+	lim.SetLimit(rate.Limit(next))
+}
+
+// onSuccess recovers ns's allowed QPS geometrically back towards maxQPS.
+func (l *nsRateLimiter) onSuccess(ns string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.servfail[ns] = 0
+	lim := l.limiters[ns]
+	if lim == nil {
+		return
+	}
+	next := float64(lim.Limit()) * 1.5
+	if next > l.maxQPS {
+		next = l.maxQPS
+	}
+	lim.SetLimit(rate.Limit(next))
+}
+
+// upstreamKey identifies the upstream being queried for the purposes of
+// rate limiting. Mining a nameserver name out of a response's authority
+// section doesn't work: ordinary answers carry no authority NS records
+// at all, and authoritative SERVFAIL/NXDOMAIN responses carry a SOA
+// there, not NS - so we key off what was actually queried (-resolver,
+// or "default" for /etc/resolv.conf) instead.
+func upstreamKey() string {
+	if *resolver != "" && *resolver != "none" {
+		return *resolver
+	}
+	return "default"
+}
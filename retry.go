@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var timeout = flag.Duration("timeout", 5*time.Second, "per-query timeout")
+var retries = flag.Int("retries", 0, "number of retries for a query that times out, fails or hits a -retry-on rcode")
+var retryOn = flag.String("retry-on", "rcodes=2,5", "retry when the rcode is in this list, format rcodes=<comma-separated rcodes>")
+var qpsPerNS = flag.Float64("qps-per-ns", 50, "starting/maximum queries per second allowed towards a single upstream resolver")
+
+var limiter = newNSRateLimiter(50, 50)
+
+// parseRetryRcodes turns -retry-on's "rcodes=2,5" syntax into a lookup
+// set; an unparseable flag value just means nothing triggers a retry
+// instead of aborting startup over a cosmetic flag.
+func parseRetryRcodes(spec string) map[int]bool {
+	set := make(map[int]bool)
+	spec = strings.TrimPrefix(spec, "rcodes=")
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(part); err == nil {
+			set[n] = true
+		}
+	}
+	return set
+}
+
+var retryRcodes = parseRetryRcodes(*retryOn)
+
+// initRetryRcodes re-parses -retry-on after flag.Parse has run; package
+// level vars are initialized before main() sees the actual flag values.
+func initRetryRcodes() {
+	retryRcodes = parseRetryRcodes(*retryOn)
+	limiter = newNSRateLimiter(*qpsPerNS, *qpsPerNS)
+}
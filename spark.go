@@ -10,18 +10,19 @@
 package main
 
 import (
-	"bufio"
 	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/miekg/unbound"
-	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var domainfile = flag.String("names", "", "file with domain names")
@@ -34,12 +35,61 @@ var print_rrs = flag.Bool("print_rrs", false, "print the resource records (if an
 var randomize = flag.Bool("randomize", false, "Add a random qname-label (for deeper inspection, but it may trigger RRL)")
 var insecure = flag.Bool("insecure", false, "Do not check DNSSEC")
 var configfile = flag.String("config", "", "libunbound configuration file")
+var format = flag.String("format", "text", "Output format: text, json, ndjson or csv")
 
-var rcode string
 var strX int
 
 var qtype = uint16(1)
 
+// Result is what each lookup goroutine produces for a single query; the
+// writer goroutine serializes it according to -format.
+type Result struct {
+	Qname      string   `json:"qname"`
+	Qtype      uint16   `json:"qtype"`
+	Rcode      int      `json:"rcode"`
+	RcodeText  string   `json:"rcode_text,omitempty"`
+	Secure     bool     `json:"secure"`
+	Bogus      bool     `json:"bogus"`
+	NxDomain   bool     `json:"nxdomain"`
+	HaveData   bool     `json:"have_data"`
+	WhyBogus   string   `json:"why_bogus,omitempty"`
+	RRs        []string `json:"rrs,omitempty"`
+	DurationMS int64    `json:"duration_ms"`
+	Err        string   `json:"err,omitempty"`
+	EDECode    int      `json:"ede_code,omitempty"`
+	EDEText    string   `json:"ede_text,omitempty"`
+	Proof      string   `json:"proof,omitempty"`
+}
+
+// extractEDE looks for an OPT record carrying an EDNS0_EDE option in an
+// answer message, as returned by u.Resolve in res.AnswerPacket.
+// libunbound surfaces whatever EDE the upstream sent, but doesn't expose
+// it through the Result struct, so we dig it back out of the message
+// ourselves.
+func extractEDE(msg *dns.Msg) (code int, text string, found bool) {
+	if msg == nil {
+		return 0, "", false
+	}
+	for _, rr := range msg.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		for _, o := range opt.Option {
+			ede, ok := o.(*dns.EDNS0_EDE)
+			if !ok {
+				continue
+			}
+			text = ede.ExtraText
+			if text == "" {
+				text = dns.ExtendedErrorCodeToString[ede.InfoCode]
+			}
+			return int(ede.InfoCode), text, true
+		}
+	}
+	return 0, "", false
+}
+
 // Random string generator
 func randString(n int) string {
 	const alphanum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
@@ -73,6 +123,19 @@ func main() {
 
 	flag.Parse()
 
+	switch *format {
+	case "text", "json", "ndjson", "csv":
+	default:
+		log.Fatalf("Unknown -format %q, must be one of text, json, ndjson, csv\n", *format)
+	}
+
+	if !validTransports[*transport] {
+		log.Fatalf("Unknown -transport %q, must be one of udp, tcp, tls, https\n", *transport)
+	}
+
+	initRetryRcodes()
+	serveMetrics()
+
 	// get RR type
 	if k, ok := dns.StringToType[strings.ToUpper(*rrtype)]; ok {
 		qtype = k
@@ -87,18 +150,33 @@ func main() {
 		}
 	}
 
-	var f io.ReadCloser
-	var e error
-	if *domainfile == "" {
-		f = os.Stdin
-	} else {
-		f, e = os.Open(*domainfile)
-		if e != nil {
-			log.Fatalf("Failed to open %s: %s\n", *domainfile, e.Error())
+	input, ierr := newInputSource()
+	if ierr != nil {
+		log.Fatalf("Failed to set up input source: %s\n", ierr.Error())
+	}
+	sink, serr := newOutputSink()
+	if serr != nil {
+		log.Fatalf("Failed to set up output sink: %s\n", serr.Error())
+	}
+
+	var u *unbound.Unbound
+	var clientPool []*upstreamClient
+
+	if directTransport() {
+		if *resolver == "" || *resolver == "none" {
+			log.Fatalf("-transport %s requires -resolver to name the upstream\n", *transport)
+		}
+		var perr error
+		clientPool, perr = newUpstreamClientPool(*routines, *resolver)
+		if perr != nil {
+			log.Fatalf("Failed to set up %s transport: %s\n", *transport, perr.Error())
+		}
+		if !*insecure {
+			fmt.Fprintf(os.Stderr, "Note: -transport %s bypasses unbound, DNSSEC verdicts reflect the upstream's AD bit rather than local validation\n", *transport)
 		}
 	}
-	defer f.Close()
-	u := unbound.New()
+
+	u = unbound.New()
 	if *configfile != "" {
 		fmt.Printf("Reading config file %s\n", *configfile)
 		err := u.Config(*configfile)
@@ -107,81 +185,178 @@ func main() {
 		}
 	}
 	defer u.Destroy()
-	if !*insecure {
-		u.AddTa(`;; ANSWER SECTION:
-.                       168307 IN DNSKEY 257 3 8 (
-                                AwEAAagAIKlVZrpC6Ia7gEzahOR+9W29euxhJhVVLOyQ
-                                bSEW0O8gcCjFFVQUTf6v58fLjwBd0YI0EzrAcQqBGCzh
-                                /RStIoO8g0NfnfL2MTJRkxoXbfDaUeVPQuYEhg37NZWA
-                                JQ9VnMVDxP/VHL496M/QZxkjf5/Efucp2gaDX6RS6CXp
-                                oY68LsvPVjR0ZSwzz1apAzvN9dlzEheX7ICJBBtuA6G3
-                                LQpzW5hOA2hzCTMjJPJ8LbqF6dsV6DoBQzgul0sGIcGO
-                                Yl7OyQdXfZ57relSQageu+ipAdTTJ25AsRTAoub8ONGc
-                                LmqrAmRLKBP1dfwhYB4N7knNnulqQxA+Uk1ihz0=
-                                ) ; key id = 19036`)
-                u.AddTa(`;; ANSWER SECTION:
-.                       172800 IN DNSKEY 257 3 8 (
-                                AwEAAaz/tAm8yTn4Mfeh5eyI96WSVexTBAvkMgJzkKTO
-                                iW1vkIbzxeF3+/4RgWOq7HrxRixHlFlExOLAJr5emLvN
-                                7SWXgnLh4+B5xQlNVz8Og8kvArMtNROxVQuCaSnIDdD5
-                                LKyWbRd2n9WGe2R8PzgCmr3EgVLrjyBxWezF0jLHwVN8
-                                efS3rCj/EWgvIWgb9tarpVUDK/b58Da+sqqls3eNbuv7
-                                pr+eoZG+SrDK6nWeL3c6H5Apxz7LjVc1uTIdsIXxuOLY
-                                A4/ilBmSVIzuDWfdRUfhHdY6+cn8HFRm+2hM8AnXGXws
-                                9555KrUB5qihylGa8subX2Nn6UwNR1AkUTV74bU=
-                                ) ; key id = 20326`)
-	}
-
-	if *resolver != "" && *resolver != "none" {
-		if e := u.SetFwd(*resolver); e != nil {
-			log.Fatalf("Failed to set resolver %s\n", e.Error())
-		} else {
-			// DEBUG fmt.Println("Using " + *resolver + "...\n")
+	if !*insecure && !directTransport() {
+		tags, err := setupTrustAnchor(u)
+		if err != nil {
+			log.Fatalf("Failed to set up DNSSEC trust anchor: %s\n", err.Error())
 		}
-	} else {
-		if *resolver == "" {
-			// DEBUG
-			// fmt.Println("Using /etc/resolv.conf...\n")
-			u.ResolvConf("/etc/resolv.conf")
+		log.Printf("Active trust anchor key tags: %v\n", tags)
+	}
+
+	if !directTransport() {
+		if *resolver != "" && *resolver != "none" {
+			if e := u.SetFwd(*resolver); e != nil {
+				log.Fatalf("Failed to set resolver %s\n", e.Error())
+			} else {
+				// DEBUG fmt.Println("Using " + *resolver + "...\n")
+			}
 		} else {
-			// DEBUG fmt.Println("Not using any caching proxy...\n")
+			if *resolver == "" {
+				// DEBUG
+				// fmt.Println("Using /etc/resolv.conf...\n")
+				u.ResolvConf("/etc/resolv.conf")
+			} else {
+				// DEBUG fmt.Println("Not using any caching proxy...\n")
+			}
 		}
 	}
 
-	chout := make(chan [2]string, *routines*2)
+	chout := make(chan Result, *routines*2)
 	chin := make(chan string, *routines*2)
 	stop := make([]chan bool, *routines)
 
-	r := bufio.NewReader(f)
 	wg := new(sync.WaitGroup)
 	wg.Add(*routines)
 	for i := 0; i < *routines; i++ {
 		stop[i] = make(chan bool)
-		go lookup(u, chin, chout, wg, stop[i])
+		if directTransport() {
+			go lookupDirect(clientPool[i], chin, chout, wg, stop[i])
+		} else {
+			go lookup(u, chin, chout, wg, stop[i])
+		}
 	}
-	line, _, e := r.ReadLine()
 	go func() {
-		for e == nil {
-			dom := strings.TrimSpace(string(line))
-			chin <- dom
-			line, _, e = r.ReadLine()
-		}
-		if e != nil {
-			for i := 0; i < *routines; i++ {
-				stop[i] <- true
-			}
-			wg.Wait()
-			close(chin)
-			close(chout)
+		if err := input.Stream(chin); err != nil {
+			log.Println("input source error:", err)
 		}
+		for i := 0; i < *routines; i++ {
+			stop[i] <- true
+		}
+		wg.Wait()
+		close(chin)
+		close(chout)
 	}()
 
-	for ret := range chout {
-		fmt.Println(ret[0], ":", ret[1])
+	if sink != nil {
+		defer sink.Close()
+		for res := range chout {
+			if err := sink.Write(res); err != nil {
+				log.Println("output sink error:", err)
+			}
+		}
+		return
+	}
+	writeOutput(chout)
+}
+
+// writeOutput drains chout and serializes each Result according to
+// -format. json/ndjson use streaming encoders so memory stays bounded
+// even when resolving millions of names.
+func writeOutput(chout chan Result) {
+	switch *format {
+	case "json":
+		fmt.Println("[")
+		enc := json.NewEncoder(os.Stdout)
+		first := true
+		for res := range chout {
+			if !first {
+				fmt.Println(",")
+			}
+			first = false
+			fmt.Print("  ")
+			enc.Encode(res)
+		}
+		fmt.Println("]")
+	case "ndjson":
+		enc := json.NewEncoder(os.Stdout)
+		for res := range chout {
+			enc.Encode(res)
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		defer w.Flush()
+		w.Write([]string{"qname", "qtype", "rcode", "secure", "bogus", "nxdomain", "have_data", "why_bogus", "rrs", "duration_ms", "err", "ede_code", "ede_text", "proof"})
+		for res := range chout {
+			w.Write([]string{
+				res.Qname,
+				strconv.Itoa(int(res.Qtype)),
+				strconv.Itoa(res.Rcode),
+				strconv.FormatBool(res.Secure),
+				strconv.FormatBool(res.Bogus),
+				strconv.FormatBool(res.NxDomain),
+				strconv.FormatBool(res.HaveData),
+				res.WhyBogus,
+				strings.Join(res.RRs, "|"),
+				strconv.FormatInt(res.DurationMS, 10),
+				res.Err,
+				strconv.Itoa(res.EDECode),
+				res.EDEText,
+				res.Proof,
+			})
+		}
+	default:
+		for res := range chout {
+			if *print_rrs {
+				for _, rr := range res.RRs {
+					fmt.Println(res.Qname, ":", rr)
+				}
+			}
+			if s := textSummary(res); s != "" {
+				fmt.Println(res.Qname, ":", s)
+			}
+		}
+	}
+}
+
+// rcodeText renders an rcode the way the tool's free-form text output
+// has always displayed it.
+func rcodeText(rcode int) string {
+	switch rcode {
+	case 0:
+		return "(0 - noerror)"
+	case 2:
+		return "(2 - servfail)"
+	case 3:
+		return "(3 - nxdomain)"
+	default:
+		return fmt.Sprintf("(rcode: %d)", rcode)
+	}
+}
+
+// textSummary reproduces the free-form "domain : message" line the tool
+// printed before structured output modes existed. An empty string means
+// no summary line is printed for res, as before for a name with data
+// under -insecure.
+func textSummary(res Result) string {
+	if res.Err != "" {
+		return res.Err
+	}
+	ede := ""
+	if res.EDEText != "" {
+		ede = fmt.Sprintf(" (EDE %d: %s)", res.EDECode, res.EDEText)
+	}
+	proof := ""
+	if res.Proof != "" {
+		proof = " proof=" + res.Proof
+	}
+	if res.HaveData || res.NxDomain {
+		if !*insecure {
+			if res.Secure {
+				return "secure" + ede + proof
+			}
+			if res.Bogus {
+				return "bogus" + ":" + res.WhyBogus + ede + proof
+			}
+			return "insecure" + ede + proof
+		} else if res.NxDomain {
+			return "nodata " + res.RcodeText + ede + proof
+		}
+		return ""
 	}
+	return "nodata " + res.RcodeText + ede + proof
 }
 
-func lookup(u *unbound.Unbound, chin chan string, chout chan [2]string, wg *sync.WaitGroup, stop chan bool) {
+func lookup(u *unbound.Unbound, chin chan string, chout chan Result, wg *sync.WaitGroup, stop chan bool) {
 
 	for {
 		select {
@@ -192,56 +367,97 @@ func lookup(u *unbound.Unbound, chin chan string, chout chan [2]string, wg *sync
 			if *randomize {
 				strX = len(d)
 				if strX > 249 { // empty string will become '.'
-					chout <- [2]string{d, "is too long for an additional randomization label, refraining"}
+					chout <- Result{Qname: d, Err: "is too long for an additional randomization label, refraining"}
 					continue
 				} else {
 					d = randString(5) + "." + d
 				}
 			}
-			res, err := u.Resolve(d, qtype, dns.ClassINET)
-			// TODO: what is the best type to ask for?
-			if err != nil {
-				chout <- [2]string{d, err.Error()}
-				continue
-			}
+			chout <- resolveWithRetry(u, d)
+		}
+	}
+}
 
-			if res.Rcode == 0 {
-				rcode = "(0 - noerror)"
-			} else {
-				if res.Rcode == 2 {
-					rcode = "(2 - servfail)"
-				} else {
-					if res.Rcode == 3 {
-						rcode = "(3 - nxdomain)"
-					} else {
-						rcode = fmt.Sprintf("(rcode: %d)", res.Rcode)
-					}
-				}
-			}
+// resolveWithRetry resolves d through u, retrying up to *retries times
+// when the query times out or fails, or its rcode is in -retry-on; every
+// attempt first waits for the queried upstream's token in the shared
+// limiter. Metrics are recorded once per logical query, covering every
+// retry it took, not once per attempt.
+func resolveWithRetry(u *unbound.Unbound, d string) Result {
+	ns := upstreamKey()
+	queryStart := time.Now()
+	var result Result
+	for attempt := 0; attempt <= *retries; attempt++ {
+		limiter.wait(ns)
+		inflight.Inc()
+		result = resolveOnceUnbound(u, d, time.Now())
+		inflight.Dec()
 
-			if res.HaveData || res.NxDomain {
-				if *print_rrs && len(res.Rr) > 0 {
-					for _, r := range res.Rr {
-						chout <- [2]string{d, strings.SplitN(r.String(), "\t", 5)[4]}
-					}
-				}
-				if !*insecure {
-					if res.Secure {
-						chout <- [2]string{d, "secure"}
-						continue
-					}
-					if res.Bogus {
-						chout <- [2]string{d, "bogus" + ":" + res.WhyBogus}
-						continue
-					}
-					chout <- [2]string{d, "insecure"}
-				} else if res.NxDomain {
-					chout <- [2]string{res.Qname, "nodata " + rcode}
-				}
-				continue
-			}
-			// return the qname instead of 'd' (because we always want to terminate with a dot)
-			chout <- [2]string{res.Qname, "nodata " + rcode}
+		if result.Err == "" && !retryRcodes[result.Rcode] {
+			limiter.onSuccess(ns)
+			break
 		}
+		limiter.onServfail(ns)
+	}
+	recordQuery(result, time.Since(queryStart).Seconds())
+	return result
+}
+
+// resolveOnceUnbound runs a single u.Resolve call under -timeout. libunbound's
+// Resolve is a blocking C call we can't cancel from the Go side, so on
+// timeout we stop waiting and return, but the goroutine below keeps
+// running until libunbound eventually answers it.
+func resolveOnceUnbound(u *unbound.Unbound, d string, start time.Time) Result {
+	type outcome struct {
+		res *unbound.Result
+		err error
+	}
+	ch := make(chan outcome, 1)
+	go func() {
+		res, err := u.Resolve(d, qtype, dns.ClassINET)
+		ch <- outcome{res, err}
+	}()
+
+	var o outcome
+	select {
+	case o = <-ch:
+	case <-time.After(*timeout):
+		return Result{Qname: d, DurationMS: (*timeout).Milliseconds(), Err: "timeout"}
 	}
+
+	duration := time.Since(start).Milliseconds()
+	if o.err != nil {
+		return Result{Qname: d, DurationMS: duration, Err: o.err.Error()}
+	}
+	res := o.res
+
+	result := Result{
+		Qname:      res.Qname,
+		Qtype:      qtype,
+		Rcode:      res.Rcode,
+		RcodeText:  rcodeText(res.Rcode),
+		Secure:     res.Secure,
+		Bogus:      res.Bogus,
+		NxDomain:   res.NxDomain,
+		HaveData:   res.HaveData,
+		WhyBogus:   res.WhyBogus,
+		DurationMS: duration,
+	}
+
+	if code, text, found := extractEDE(res.AnswerPacket); found {
+		result.EDECode = code
+		result.EDEText = text
+	}
+
+	if (res.HaveData || res.NxDomain) && *print_rrs && len(res.Rr) > 0 {
+		for _, rr := range res.Rr {
+			result.RRs = append(result.RRs, strings.SplitN(rr.String(), "\t", 5)[4])
+		}
+	}
+
+	if *dnssecProof && (result.NxDomain || (result.Rcode == dns.RcodeSuccess && !result.HaveData)) {
+		result.Proof = checkDenialProof(d, result.NxDomain, res.AnswerPacket)
+	}
+
+	return result
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// By default spark hands every query to unbound's own Do53 forwarder
+// (-resolver, via u.SetFwd). -transport lets it bypass unbound entirely
+// and talk to an upstream directly through github.com/miekg/dns instead -
+// either to force TCP, or to speak an encrypted transport the mainstream
+// public resolvers now expect.
+var transport = flag.String("transport", "udp", "Upstream transport: udp, tcp, tls or https")
+var resolverName = flag.String("resolver-name", "", "Server name for SNI/certificate verification when -transport is tls or https")
+
+// validTransports are the only values -transport accepts; checked at
+// startup the same way -format is, rather than letting an unrecognized
+// value silently fall back to udp.
+var validTransports = map[string]bool{"udp": true, "tcp": true, "tls": true, "https": true}
+
+// directTransport reports whether queries should bypass unbound's builtin
+// forwarder and be dispatched directly via upstreamClient instead. udp
+// stays on unbound's own Do53 forwarder, same as if -transport were never
+// given.
+func directTransport() bool {
+	switch *transport {
+	case "tcp", "tls", "https":
+		return true
+	}
+	return false
+}
+
+// defaultPort fills in the well-known port for addr when the user didn't
+// specify one, based on the selected transport.
+func defaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		// already host:port
+		return addr
+	}
+	if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+		// a bare IPv6 address with no port - leave those alone, they'll
+		// fail to dial with a clear error
+		return addr
+	}
+	switch *transport {
+	case "tls":
+		return addr + ":853"
+	case "https":
+		if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+			return addr
+		}
+		return "https://" + addr + "/dns-query"
+	default:
+		return addr + ":53"
+	}
+}
+
+// upstreamClient sends one query over the configured transport and
+// returns the raw answer, independent of whether unbound is involved at
+// all. A pool of these (one per worker goroutine) replaces u.Resolve
+// when -transport is tcp, tls or https.
+type upstreamClient struct {
+	dnsClient  *dns.Client
+	httpClient *http.Client
+	addr       string
+}
+
+// newUpstreamClientPool builds n upstreamClients for -resolver, sized to
+// match -goroutines so each worker gets its own connection state.
+func newUpstreamClientPool(n int, addr string) ([]*upstreamClient, error) {
+	addr = defaultPort(addr)
+	pool := make([]*upstreamClient, n)
+	for i := range pool {
+		c, err := newUpstreamClient(addr)
+		if err != nil {
+			return nil, err
+		}
+		pool[i] = c
+	}
+	return pool, nil
+}
+
+func newUpstreamClient(addr string) (*upstreamClient, error) {
+	switch *transport {
+	case "tcp":
+		return &upstreamClient{
+			addr:      addr,
+			dnsClient: &dns.Client{Net: "tcp", Timeout: 5 * time.Second},
+		}, nil
+	case "tls":
+		return &upstreamClient{
+			addr: addr,
+			dnsClient: &dns.Client{
+				Net:       "tcp-tls",
+				Timeout:   5 * time.Second,
+				TLSConfig: &tls.Config{ServerName: *resolverName},
+			},
+		}, nil
+	case "https":
+		return &upstreamClient{
+			addr: addr,
+			httpClient: &http.Client{
+				Timeout: 5 * time.Second,
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{ServerName: *resolverName},
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported direct transport %q", *transport)
+	}
+}
+
+// exchange sends m and returns the parsed answer, using DNS-over-HTTPS
+// (RFC 8484) framing when the client was built for -transport https.
+func (c *upstreamClient) exchange(m *dns.Msg) (*dns.Msg, error) {
+	return c.exchangeContext(context.Background(), m)
+}
+
+// exchangeContext is exchange with a caller-supplied deadline, so
+// resolveOnceDirect's -timeout can actually cancel the in-flight query
+// instead of just giving up on waiting for it.
+func (c *upstreamClient) exchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if c.httpClient != nil {
+		return c.exchangeDoH(ctx, m)
+	}
+	in, _, err := c.dnsClient.ExchangeContext(ctx, m, c.addr)
+	return in, err
+}
+
+func (c *upstreamClient) exchangeDoH(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.addr, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query to %s returned %s", c.addr, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// lookupDirect is the -transport {tcp,tls,https} counterpart of lookup:
+// it never touches unbound, so DNSSEC validation can only rely on the
+// upstream's own AD bit. With -insecure unset we still set the DO bit
+// and report Secure based on AD, trusting the upstream to have done the
+// validation; run with the default -transport udp (unbound's own
+// forwarder) if that trust isn't acceptable.
+func lookupDirect(client *upstreamClient, chin chan string, chout chan Result, wg *sync.WaitGroup, stop chan bool) {
+
+	for {
+		select {
+		case <-stop:
+			wg.Done()
+			return
+		case d := <-chin:
+			if *randomize {
+				strX = len(d)
+				if strX > 249 {
+					chout <- Result{Qname: d, Err: "is too long for an additional randomization label, refraining"}
+					continue
+				}
+				d = randString(5) + "." + d
+			}
+			chout <- resolveWithRetryDirect(client, d)
+		}
+	}
+}
+
+// resolveWithRetryDirect is lookupDirect's counterpart to
+// resolveWithRetry: same retry/-retry-on/rate-limiter handling, but
+// against a dns.Client/http.Client instead of unbound. Metrics are
+// recorded once per logical query, covering every retry it took, not
+// once per attempt.
+func resolveWithRetryDirect(client *upstreamClient, d string) Result {
+	ns := client.addr
+	queryStart := time.Now()
+	var result Result
+	for attempt := 0; attempt <= *retries; attempt++ {
+		limiter.wait(ns)
+		inflight.Inc()
+		result = resolveOnceDirect(client, d, time.Now())
+		inflight.Dec()
+
+		if result.Err == "" && !retryRcodes[result.Rcode] {
+			limiter.onSuccess(ns)
+			break
+		}
+		limiter.onServfail(ns)
+	}
+	recordQuery(result, time.Since(queryStart).Seconds())
+	return result
+}
+
+func resolveOnceDirect(client *upstreamClient, d string, start time.Time) Result {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(d), qtype)
+	m.RecursionDesired = true
+	if !*insecure {
+		m.SetEdns0(4096, true) // DO bit
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	in, err := client.exchangeContext(ctx, m)
+	duration := time.Since(start).Milliseconds()
+	if err != nil {
+		return Result{Qname: d, DurationMS: duration, Err: err.Error()}
+	}
+
+	result := Result{
+		Qname:      dns.Fqdn(d),
+		Qtype:      qtype,
+		Rcode:      in.Rcode,
+		RcodeText:  rcodeText(in.Rcode),
+		NxDomain:   in.Rcode == dns.RcodeNameError,
+		HaveData:   len(in.Answer) > 0,
+		Secure:     !*insecure && in.AuthenticatedData,
+		DurationMS: duration,
+	}
+
+	if *print_rrs {
+		for _, rr := range in.Answer {
+			result.RRs = append(result.RRs, strings.SplitN(rr.String(), "\t", 5)[4])
+		}
+	}
+
+	if code, text, found := extractEDE(in); found {
+		result.EDECode = code
+		result.EDEText = text
+	}
+
+	if *dnssecProof && (result.NxDomain || (result.Rcode == dns.RcodeSuccess && !result.HaveData)) {
+		result.Proof = checkDenialProof(d, result.NxDomain, in)
+	}
+	return result
+}